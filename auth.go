@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const sessionCookieName = "osr_session"
+
+// sessionToken is the payload signed into the auth cookie. It never touches
+// the database, so there's no server-side session table to clean up.
+type sessionToken struct {
+	User      string `json:"user"`
+	IssuedAt  int64  `json:"issued_at"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// loadOrCreateSigningKey returns the HMAC key used to sign session cookies.
+// SESSION_SIGNING_KEY takes precedence; otherwise a key is generated once
+// and persisted in the settings table so it survives restarts.
+func (s *Server) loadOrCreateSigningKey() ([]byte, error) {
+	if v := os.Getenv("SESSION_SIGNING_KEY"); v != "" {
+		return []byte(v), nil
+	}
+
+	var stored string
+	err := s.db.QueryRow(`SELECT value FROM settings WHERE key = 'session_signing_key'`).Scan(&stored)
+	if err == nil {
+		return hex.DecodeString(stored)
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := s.db.Exec(`INSERT INTO settings (key, value) VALUES ('session_signing_key', ?)`, hex.EncodeToString(key)); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// sessionTTLFromEnv reads SESSION_DAYS_VALID, defaulting to a week.
+func sessionTTLFromEnv() time.Duration {
+	days := 7
+	if v := os.Getenv("SESSION_DAYS_VALID"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			days = n
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func (s *Server) signToken(token sessionToken) (string, error) {
+	payload, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	encodedPayload := base64.RawURLEncoding.EncodeToString(payload)
+
+	mac := hmac.New(sha256.New, s.sessionSigningKey)
+	mac.Write([]byte(encodedPayload))
+	sig := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+
+	return encodedPayload + "." + sig, nil
+}
+
+func (s *Server) verifyToken(value string) (*sessionToken, error) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("malformed session cookie")
+	}
+	encodedPayload, sig := parts[0], parts[1]
+
+	mac := hmac.New(sha256.New, s.sessionSigningKey)
+	mac.Write([]byte(encodedPayload))
+	expectedSig := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	if subtle.ConstantTimeCompare([]byte(sig), []byte(expectedSig)) != 1 {
+		return nil, fmt.Errorf("invalid session signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, err
+	}
+	var token sessionToken
+	if err := json.Unmarshal(payload, &token); err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() > token.ExpiresAt {
+		return nil, fmt.Errorf("session expired")
+	}
+	return &token, nil
+}
+
+func (s *Server) setSessionCookie(w http.ResponseWriter, r *http.Request, user string) error {
+	now := time.Now()
+	token := sessionToken{
+		User:      user,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(s.sessionTTL).Unix(),
+	}
+	value, err := s.signToken(token)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    value,
+		Path:     "/",
+		Expires:  now.Add(s.sessionTTL),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// sessionAuth replaces the old Basic Auth middleware: it validates the
+// signed cookie set by loginHandler instead of re-checking credentials on
+// every request.
+func (s *Server) sessionAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(sessionCookieName)
+		if err != nil {
+			s.denyAuth(w, r)
+			return
+		}
+		if _, err := s.verifyToken(cookie.Value); err != nil {
+			s.denyAuth(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// denyAuth responds to a failed auth check: API routes get a plain 401,
+// browser routes get bounced to the login page.
+func (s *Server) denyAuth(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
+
+func (s *Server) loginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		s.renderLoginPage(w, "")
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	user := r.FormValue("username")
+	pass := r.FormValue("password")
+
+	if subtle.ConstantTimeCompare([]byte(user), []byte(s.username)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(pass), []byte(s.password)) != 1 {
+		s.renderLoginPage(w, "Benutzername oder Passwort ist falsch.")
+		return
+	}
+
+	if err := s.setSessionCookie(w, r, user); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func (s *Server) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	clearSessionCookie(w)
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
+
+func (s *Server) renderLoginPage(w http.ResponseWriter, errMsg string) {
+	tmpl := `
+<!DOCTYPE html>
+<html lang="de">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Anmelden - Session Recorder Admin</title>
+    <style>
+        body { font-family: Arial, sans-serif; background: #f5f5f5; display: flex; align-items: center; justify-content: center; height: 100vh; margin: 0; }
+        .login-box { background: white; padding: 30px 40px; border-radius: 8px; box-shadow: 0 2px 4px rgba(0,0,0,0.1); width: 300px; }
+        h1 { color: #333; font-size: 20px; text-align: center; margin-top: 0; }
+        label { display: block; margin-bottom: 5px; color: #555; font-size: 14px; }
+        input { width: 100%; padding: 8px; margin-bottom: 15px; border: 1px solid #ddd; border-radius: 4px; box-sizing: border-box; }
+        button { width: 100%; padding: 10px; background: #007cba; color: white; border: none; border-radius: 4px; cursor: pointer; }
+        button:hover { background: #006ba1; }
+        .error { color: #d32f2f; font-size: 14px; margin-bottom: 15px; text-align: center; }
+    </style>
+</head>
+<body>
+    <div class="login-box">
+        <h1>🎥 Session Recorder Admin</h1>
+        {{if .Error}}<div class="error">{{.Error}}</div>{{end}}
+        <form method="POST" action="/login">
+            <label for="username">Benutzername</label>
+            <input type="text" id="username" name="username" autocomplete="username" required>
+            <label for="password">Passwort</label>
+            <input type="password" id="password" name="password" autocomplete="current-password" required>
+            <button type="submit">Anmelden</button>
+        </form>
+    </div>
+</body>
+</html>
+`
+	t, err := template.New("login").Parse(tmpl)
+	if err != nil {
+		http.Error(w, "Template error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	t.Execute(w, struct{ Error string }{Error: errMsg})
+}
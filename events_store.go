@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// eventsSchema creates the append-only chunk store that backs session
+// playback. Each ingest batch is inserted as its own row instead of
+// rewriting the whole session, so recording a long session is O(1) per
+// batch rather than O(N) bytes rewritten.
+const eventsSchema = `
+CREATE TABLE IF NOT EXISTS session_events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	session_id TEXT NOT NULL,
+	seq INTEGER NOT NULL,
+	ts_start INTEGER NOT NULL DEFAULT 0,
+	ts_end INTEGER NOT NULL DEFAULT 0,
+	payload BLOB NOT NULL,
+	compressed BOOLEAN NOT NULL DEFAULT 0
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_session_events_seq ON session_events(session_id, seq);
+`
+
+// ensureEventCountColumn adds event_count to session_events for trees that
+// created the table before this column existed. SQLite has no
+// "ADD COLUMN IF NOT EXISTS", so a duplicate-column error is treated as
+// already-migrated.
+func ensureEventCountColumn(db *sql.DB) error {
+	_, err := db.Exec(`ALTER TABLE session_events ADD COLUMN event_count INTEGER NOT NULL DEFAULT 0`)
+	if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		return err
+	}
+	return nil
+}
+
+// migrateLegacyEvents moves any data still sitting in the old sessions.events
+// column into session_events as a single seq=1 chunk, then clears the
+// column. It is cheap to run on every boot: sessions that have already been
+// migrated have an empty events column and are skipped.
+func (s *Server) migrateLegacyEvents() error {
+	rows, err := s.db.Query(`SELECT id, session_id, events FROM sessions WHERE events != ''`)
+	if err != nil {
+		return err
+	}
+
+	type legacySession struct {
+		id        int
+		sessionID string
+		events    string
+	}
+	var pending []legacySession
+	for rows.Next() {
+		var ls legacySession
+		if err := rows.Scan(&ls.id, &ls.sessionID, &ls.events); err != nil {
+			continue
+		}
+		pending = append(pending, ls)
+	}
+	rows.Close()
+
+	for _, ls := range pending {
+		var events []json.RawMessage
+		if err := json.Unmarshal([]byte(ls.events), &events); err != nil {
+			log.Printf("Error migrating legacy events for session %s: %v", ls.sessionID, err)
+			continue
+		}
+
+		payload, err := gzipMarshal(events)
+		if err != nil {
+			log.Printf("Error compressing legacy events for session %s: %v", ls.sessionID, err)
+			continue
+		}
+		tsStart, tsEnd := eventTimestampRange(events)
+
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT OR IGNORE INTO session_events (session_id, seq, ts_start, ts_end, payload, compressed, event_count) VALUES (?, 1, ?, ?, ?, 1, ?)`,
+			ls.sessionID, tsStart, tsEnd, payload, len(events))
+		if err != nil {
+			tx.Rollback()
+			log.Printf("Error inserting migrated chunk for session %s: %v", ls.sessionID, err)
+			continue
+		}
+		if _, err := tx.Exec(`UPDATE sessions SET events = '' WHERE id = ?`, ls.id); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendEventChunk stores one ingest batch as a new, immutable chunk. It
+// never reads or rewrites previously stored chunks.
+func (s *Server) appendEventChunk(sessionID string, events []interface{}) error {
+	data, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	tsStart, tsEnd := eventTimestampRange(raw)
+	payload, err := gzipBytes(data)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var seq int64
+	err = tx.QueryRow(`SELECT COALESCE(MAX(seq), 0) + 1 FROM session_events WHERE session_id = ?`, sessionID).Scan(&seq)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`INSERT INTO session_events (session_id, seq, ts_start, ts_end, payload, compressed, event_count) VALUES (?, ?, ?, ?, ?, 1, ?)`,
+		sessionID, seq, tsStart, tsEnd, payload, len(events)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE sessions SET updated_at = CURRENT_TIMESTAMP WHERE session_id = ?`, sessionID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// sessionEventCount returns how many events are already stored for a
+// session, summed cheaply over chunk metadata rather than by reading and
+// parsing every payload.
+func (s *Server) sessionEventCount(sessionID string) (int, error) {
+	var count int
+	err := s.db.QueryRow(`SELECT COALESCE(SUM(event_count), 0) FROM session_events WHERE session_id = ?`, sessionID).Scan(&count)
+	return count, err
+}
+
+// streamSessionEvents writes every chunk of a session, in seq order, to w as
+// a single JSON array. It never holds the full session in memory: each
+// chunk is decompressed and re-emitted as it is read off the row cursor.
+func streamSessionEvents(w io.Writer, db *sql.DB, sessionID string) error {
+	rows, err := db.Query(`SELECT payload, compressed FROM session_events WHERE session_id = ? ORDER BY seq ASC`, sessionID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+
+	wroteEvent := false
+	for rows.Next() {
+		var payload []byte
+		var compressed bool
+		if err := rows.Scan(&payload, &compressed); err != nil {
+			return err
+		}
+
+		raw := payload
+		if compressed {
+			raw, err = gunzip(payload)
+			if err != nil {
+				return err
+			}
+		}
+
+		// raw is a compact JSON array ("[...]"); strip the brackets so
+		// chunks can be concatenated into one array without re-parsing
+		// every event.
+		inner := bytes.TrimSpace(raw)
+		if len(inner) < 2 {
+			continue
+		}
+		inner = inner[1 : len(inner)-1]
+		if len(inner) == 0 {
+			continue
+		}
+
+		if wroteEvent {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(inner); err != nil {
+			return err
+		}
+		wroteEvent = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "]")
+	return err
+}
+
+func gzipMarshal(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return gzipBytes(data)
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(data); err != nil {
+		gw.Close()
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("gunzip: %w", err)
+	}
+	defer gr.Close()
+	return io.ReadAll(gr)
+}
+
+// eventTimestampRange pulls the min/max "timestamp" field out of a batch of
+// rrweb events, falling back to 0 when events don't carry one.
+func eventTimestampRange(events []json.RawMessage) (int64, int64) {
+	var tsStart, tsEnd int64
+	first := true
+	for _, raw := range events {
+		var e struct {
+			Timestamp int64 `json:"timestamp"`
+		}
+		if err := json.Unmarshal(raw, &e); err != nil || e.Timestamp == 0 {
+			continue
+		}
+		if first {
+			tsStart, tsEnd = e.Timestamp, e.Timestamp
+			first = false
+			continue
+		}
+		if e.Timestamp < tsStart {
+			tsStart = e.Timestamp
+		}
+		if e.Timestamp > tsEnd {
+			tsEnd = e.Timestamp
+		}
+	}
+	return tsStart, tsEnd
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newTestEventsServer(t *testing.T) *Server {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("open test db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec(eventsSchema); err != nil {
+		t.Fatalf("create events schema: %v", err)
+	}
+	if err := ensureEventCountColumn(db); err != nil {
+		t.Fatalf("ensureEventCountColumn: %v", err)
+	}
+	// appendEventChunk touches sessions.updated_at, so a minimal sessions
+	// table (with rows for every session_id the tests use) needs to exist too.
+	if _, err := db.Exec(`CREATE TABLE sessions (session_id TEXT PRIMARY KEY, updated_at TEXT)`); err != nil {
+		t.Fatalf("create sessions table: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO sessions (session_id) VALUES ('s1')`); err != nil {
+		t.Fatalf("seed sessions row: %v", err)
+	}
+	return &Server{db: db}
+}
+
+func streamAndDecode(t *testing.T, db *sql.DB, sessionID string) []map[string]interface{} {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := streamSessionEvents(&buf, db, sessionID); err != nil {
+		t.Fatalf("streamSessionEvents: %v", err)
+	}
+	var events []map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &events); err != nil {
+		t.Fatalf("decode streamed events %q: %v", buf.String(), err)
+	}
+	return events
+}
+
+func TestStreamSessionEventsNoChunks(t *testing.T) {
+	s := newTestEventsServer(t)
+	events := streamAndDecode(t, s.db, "missing-session")
+	if len(events) != 0 {
+		t.Errorf("got %d events, want 0", len(events))
+	}
+}
+
+func TestStreamSessionEventsSingleChunk(t *testing.T) {
+	s := newTestEventsServer(t)
+	if err := s.appendEventChunk("s1", []interface{}{
+		map[string]interface{}{"type": 4.0, "timestamp": 1.0},
+	}); err != nil {
+		t.Fatalf("appendEventChunk: %v", err)
+	}
+
+	events := streamAndDecode(t, s.db, "s1")
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want 1", len(events))
+	}
+	if events[0]["type"].(float64) != 4 {
+		t.Errorf("got type %v, want 4", events[0]["type"])
+	}
+}
+
+func TestStreamSessionEventsMultipleChunksPreserveOrder(t *testing.T) {
+	s := newTestEventsServer(t)
+	if err := s.appendEventChunk("s1", []interface{}{
+		map[string]interface{}{"type": 4.0, "timestamp": 1.0},
+	}); err != nil {
+		t.Fatalf("appendEventChunk 1: %v", err)
+	}
+	if err := s.appendEventChunk("s1", []interface{}{
+		map[string]interface{}{"type": 3.0, "timestamp": 2.0},
+		map[string]interface{}{"type": 3.0, "timestamp": 3.0},
+	}); err != nil {
+		t.Fatalf("appendEventChunk 2: %v", err)
+	}
+
+	events := streamAndDecode(t, s.db, "s1")
+	if len(events) != 3 {
+		t.Fatalf("got %d events, want 3", len(events))
+	}
+	for i, wantTS := range []float64{1, 2, 3} {
+		if events[i]["timestamp"].(float64) != wantTS {
+			t.Errorf("event %d: got timestamp %v, want %v", i, events[i]["timestamp"], wantTS)
+		}
+	}
+}
+
+func TestStreamSessionEventsMixedCompressedFlags(t *testing.T) {
+	s := newTestEventsServer(t)
+
+	// seq 1: stored uncompressed, as a pre-chunk0-1 row would be.
+	if _, err := s.db.Exec(
+		`INSERT INTO session_events (session_id, seq, payload, compressed, event_count) VALUES (?, 1, ?, 0, 1)`,
+		"s1", []byte(`[{"type":4,"timestamp":1}]`)); err != nil {
+		t.Fatalf("insert uncompressed chunk: %v", err)
+	}
+
+	// seq 2: stored gzip-compressed, as appendEventChunk always writes.
+	if err := s.appendEventChunk("s1", []interface{}{
+		map[string]interface{}{"type": 3.0, "timestamp": 2.0},
+	}); err != nil {
+		t.Fatalf("appendEventChunk: %v", err)
+	}
+
+	events := streamAndDecode(t, s.db, "s1")
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+	if events[0]["timestamp"].(float64) != 1 || events[1]["timestamp"].(float64) != 2 {
+		t.Errorf("events out of order or wrong content: %+v", events)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// liveBroadcastBuffer is how many pending batches a single slow admin
+// viewer can fall behind before we start dropping the oldest ones, so a
+// stuck client can never back-pressure ingest.
+const liveBroadcastBuffer = 16
+
+// liveConn is one connected admin viewer watching a session live.
+type liveConn struct {
+	ws   *websocket.Conn
+	send chan []byte
+}
+
+// liveHub fans out newly-ingested event batches to every admin viewer
+// currently watching a given session.
+type liveHub struct {
+	mu    sync.RWMutex
+	conns map[string]map[*liveConn]struct{}
+}
+
+func newLiveHub() *liveHub {
+	return &liveHub{conns: make(map[string]map[*liveConn]struct{})}
+}
+
+func (h *liveHub) register(sessionID string, c *liveConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conns[sessionID] == nil {
+		h.conns[sessionID] = make(map[*liveConn]struct{})
+	}
+	h.conns[sessionID][c] = struct{}{}
+}
+
+func (h *liveHub) unregister(sessionID string, c *liveConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.conns[sessionID], c)
+	if len(h.conns[sessionID]) == 0 {
+		delete(h.conns, sessionID)
+	}
+	close(c.send)
+}
+
+// broadcast fans a batch out to every viewer of sessionID. A viewer whose
+// buffer is full has its oldest pending batch dropped to make room, rather
+// than blocking the broadcaster.
+func (h *liveHub) broadcast(sessionID string, payload []byte) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for c := range h.conns[sessionID] {
+		select {
+		case c.send <- payload:
+		default:
+			select {
+			case <-c.send:
+			default:
+			}
+			select {
+			case c.send <- payload:
+			default:
+			}
+		}
+	}
+}
+
+var liveUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     checkLiveOrigin,
+}
+
+// checkLiveOrigin rejects cross-site WebSocket handshakes. Browsers attach
+// cookies to a WS upgrade without the SOP restrictions fetch() gets, so
+// sessionAuth passing on its own isn't enough: a page on another origin
+// could open a socket here and ride the admin's cookie through it
+// (cross-site WebSocket hijacking). Same-origin requests have no Origin
+// header at all, so those are allowed through too.
+func checkLiveOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return u.Host == r.Host
+}
+
+// liveWSHandler upgrades a /ws/live/{sessionID} request and streams newly
+// ingested batches for that session to the caller until it disconnects.
+func (s *Server) liveWSHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := strings.TrimPrefix(r.URL.Path, "/ws/live/")
+	if sessionID == "" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	ws, err := liveUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Error upgrading live websocket for session %s: %v", sessionID, err)
+		return
+	}
+
+	conn := &liveConn{ws: ws, send: make(chan []byte, liveBroadcastBuffer)}
+	s.liveHub.register(sessionID, conn)
+	defer s.liveHub.unregister(sessionID, conn)
+
+	go conn.readPump()
+	conn.writePump()
+}
+
+// readPump drains and discards any messages the client sends (the protocol
+// is server-to-client only) and exits as soon as the connection closes,
+// which is what tells writePump to stop.
+func (c *liveConn) readPump() {
+	defer c.ws.Close()
+	c.ws.SetReadLimit(512)
+	for {
+		if _, _, err := c.ws.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+func (c *liveConn) writePump() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	defer c.ws.Close()
+
+	for {
+		select {
+		case payload, ok := <-c.send:
+			if !ok {
+				c.ws.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.ws.WriteMessage(websocket.TextMessage, payload); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := c.ws.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// broadcastLiveEvents is called after a batch has been persisted so any
+// connected live viewers can render it immediately.
+func (s *Server) broadcastLiveEvents(sessionID string, events []interface{}) {
+	if len(events) == 0 {
+		return
+	}
+	payload, err := json.Marshal(events)
+	if err != nil {
+		log.Printf("Error marshaling live events for session %s: %v", sessionID, err)
+		return
+	}
+	s.liveHub.broadcast(sessionID, payload)
+}
+
+// liveReplayHandler serves the live-replay page for a session: it seeds the
+// player with whatever has already been recorded, then subscribes over
+// WebSocket to stream in new batches as they arrive.
+func (s *Server) liveReplayHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := strings.TrimPrefix(r.URL.Path, "/live/")
+
+	var session Session
+	query := `SELECT session_id, url, title, user_agent, created_at, viewport FROM sessions WHERE session_id = ?`
+	err := s.db.QueryRow(query, sessionID).Scan(
+		&session.SessionID, &session.URL, &session.Title,
+		&session.UserAgent, &session.CreatedAt, &session.Viewport)
+	if err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	tmpl := `
+<!DOCTYPE html>
+<html lang="de">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Live: {{.Title}}</title>
+    <link rel="stylesheet" href="/rrweb-player.css">
+    <style>
+        body { font-family: Arial, sans-serif; margin: 0; background: #1a1a1a; color: white; }
+        .header { background: #333; padding: 15px; border-bottom: 2px solid #007cba; display: flex; align-items: center; gap: 10px; }
+        .header h1 { margin: 0; color: #007cba; font-size: 18px; }
+        .live-badge { background: #d32f2f; color: white; padding: 2px 8px; border-radius: 10px; font-size: 12px; }
+        .session-info { background: #222; padding: 10px 15px; font-size: 14px; }
+        .session-info span { margin-right: 20px; }
+        #player { width: 100%; height: calc(100vh - 100px); }
+        .error { color: #f44336; text-align: center; padding: 20px; }
+    </style>
+    <script src="/{{.RrWebJs}}"></script>
+    <script src="/rrweb-player.js"></script>
+</head>
+<body>
+    <div class="header">
+        <h1>🎥 Live Replay</h1>
+        <span id="liveBadge" class="live-badge">🔴 LIVE</span>
+    </div>
+    <div class="session-info">
+        <span><strong>URL:</strong> <a href="{{.URL}}" target="_blank" style="color: #007cba;">{{.URL}}</a></span>
+        <span><strong>Titel:</strong> {{.Title}}</span>
+    </div>
+    <div id="player"></div>
+
+    <script>
+        (async function () {
+            let events = [];
+            try {
+                const response = await fetch('/api/sessions/{{.SessionID}}/events');
+                events = await response.json();
+            } catch (error) {
+                console.error('Error loading initial events:', error);
+            }
+            if (!Array.isArray(events)) {
+                events = [];
+            }
+
+            const player = new rrwebPlayer({
+                target: document.getElementById('player'),
+                props: {
+                    events: events.length ? events : [{ type: 4, data: {}, timestamp: Date.now() }],
+                    width: window.innerWidth,
+                    height: window.innerHeight - 100,
+                    autoPlay: true,
+                    showController: true,
+                    liveMode: true,
+                }
+            });
+            if (events.length) {
+                player.getReplayer().enableInteract();
+                player.getReplayer().startLive(events[events.length - 1].timestamp);
+            }
+
+            const protocol = location.protocol === 'https:' ? 'wss:' : 'ws:';
+            const ws = new WebSocket(protocol + '//' + location.host + '/ws/live/{{.SessionID}}');
+            ws.onmessage = function (event) {
+                const batch = JSON.parse(event.data);
+                batch.forEach(function (e) {
+                    player.addEvent(e);
+                });
+            };
+            ws.onclose = function () {
+                document.getElementById('liveBadge').textContent = '⚪ DISCONNECTED';
+            };
+        })();
+    </script>
+</body>
+</html>
+`
+	t, err := template.New("live").Parse(tmpl)
+	if err != nil {
+		http.Error(w, "Template error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	t.Execute(w, struct {
+		Session
+		RrWebJs string
+	}{Session: session, RrWebJs: s.rrWebJs})
+}
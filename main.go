@@ -1,7 +1,6 @@
 package main
 
 import (
-	"crypto/subtle"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -9,6 +8,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -16,6 +16,13 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// validSessionID matches the recorder-generated session IDs this server
+// expects. It's enforced at the only place new IDs enter the system
+// (sessionMetadataHandler) because session IDs are later interpolated into
+// S3 archive keys and file-ish paths; a "/" or ".." would let a malicious
+// recorder escape the intended key prefix.
+var validSessionID = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,128}$`)
+
 // Session represents a recorded session
 type Session struct {
 	ID        int       `json:"id"`
@@ -51,15 +58,20 @@ type EventBatch struct {
 
 // Server holds the database connection and handlers
 type Server struct {
-	db         *sql.DB
-	username   string
-	password   string
-	rrWebJs    string
-	recorderJs string
+	db                *sql.DB
+	username          string
+	password          string
+	rrWebJs           string
+	recorderJs        string
+	processorConfig   ProcessorConfig
+	sessionSigningKey []byte
+	sessionTTL        time.Duration
+	liveHub           *liveHub
+	searchEnabled     bool
 }
 
 func main() {
-	server := &Server{}
+	server := &Server{liveHub: newLiveHub()}
 
 	// Initialize database
 	if err := server.initDB(); err != nil {
@@ -78,6 +90,14 @@ func main() {
 	server.password = os.Getenv("BASIC_AUTH_PASS")
 	server.rrWebJs = os.Getenv("RRWEB_JS_NAME")
 	server.recorderJs = os.Getenv("RECORDER_JS_NAME")
+	server.processorConfig = loadProcessorConfig()
+	server.sessionTTL = sessionTTLFromEnv()
+
+	signingKey, err := server.loadOrCreateSigningKey()
+	if err != nil {
+		log.Fatal("Failed to load session signing key:", err)
+	}
+	server.sessionSigningKey = signingKey
 
 	if server.username == "" {
 		server.username = "admin"
@@ -94,10 +114,19 @@ func main() {
 	}
 
 	// Routes
-	// Admin routes with BasicAuth
-	http.HandleFunc("/", server.basicAuth(server.adminHandler))
-	http.HandleFunc("/api/sessions", server.basicAuth(server.corsMiddleware(server.getSessionsHandler)))
-	http.HandleFunc("/session/", server.basicAuth(server.viewSessionHandler))
+	// Admin routes, gated behind the signed session cookie
+	http.HandleFunc("/", server.sessionAuth(server.adminHandler))
+	http.HandleFunc("/api/sessions", server.sessionAuth(server.corsMiddleware(server.getSessionsHandler)))
+	http.HandleFunc("/api/sessions/search", server.sessionAuth(server.searchSessionsHandler))
+	http.HandleFunc("/api/sessions/import", server.sessionAuth(server.importSessionHandler))
+	http.HandleFunc("/api/sessions/", server.sessionAuth(server.sessionsByIDHandler))
+	http.HandleFunc("/session/", server.sessionAuth(server.viewSessionHandler))
+	http.HandleFunc("/live/", server.sessionAuth(server.liveReplayHandler))
+	http.HandleFunc("/ws/live/", server.sessionAuth(server.liveWSHandler))
+
+	// Login/logout, unauthenticated by definition
+	http.HandleFunc("/login", server.loginHandler)
+	http.HandleFunc("/logout", server.logoutHandler)
 
 	// Public API routes (for recording)
 	http.HandleFunc("/api/sessions/metadata", server.corsMiddleware(server.sessionMetadataHandler))
@@ -109,6 +138,9 @@ func main() {
 	http.HandleFunc("/rrweb-player.js", server.serveRrwebPlayerJS)
 	http.HandleFunc("/rrweb-player.css", server.serveRrwebPlayerCSS)
 
+	go server.runIdleSessionFinalizer()
+	go server.runRetentionJanitor()
+
 	fmt.Printf("Server starting on :%s\n", port)
 	fmt.Printf("Admin interface: http://localhost:%s\n", port)
 	log.Fatal(http.ListenAndServe(":"+port, nil))
@@ -122,10 +154,16 @@ func (s *Server) initDB() error {
 		dbPath = "./data/sessions.db"
 	}
 
-	s.db, err = sql.Open("sqlite3", dbPath)
+	// _busy_timeout makes SQLite retry for up to 5s instead of immediately
+	// returning SQLITE_BUSY when a writer collides with another connection.
+	// A single shared connection then serializes writes on the Go side too,
+	// which matters once ingest, the FTS upsert, the idle finalizer, and
+	// the retention janitor are all writing to the same file concurrently.
+	s.db, err = sql.Open("sqlite3", dbPath+"?_busy_timeout=5000")
 	if err != nil {
 		return err
 	}
+	s.db.SetMaxOpenConns(1)
 
 	// Create sessions table
 	query := `
@@ -142,10 +180,40 @@ func (s *Server) initDB() error {
 	);
 	CREATE INDEX IF NOT EXISTS idx_session_id ON sessions(session_id);
 	CREATE INDEX IF NOT EXISTS idx_created_at ON sessions(created_at DESC);
+
+	CREATE TABLE IF NOT EXISTS settings (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);
 	`
 
-	_, err = s.db.Exec(query)
-	return err
+	if _, err := s.db.Exec(query); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(eventsSchema); err != nil {
+		return err
+	}
+	if err := ensureEventCountColumn(s.db); err != nil {
+		return err
+	}
+	if err := ensureSearchColumns(s.db); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(searchSchema); err != nil {
+		// FTS5 is only compiled in when the binary is built with
+		// "-tags sqlite_fts5" (see Makefile). Anyone running "go run ."
+		// or a plain "go build" still gets a working recorder/replay/auth
+		// server - they just lose full-text search until they rebuild
+		// with the tag.
+		if strings.Contains(err.Error(), "no such module: fts5") {
+			log.Println("Warning: SQLite built without fts5 (rebuild with -tags sqlite_fts5 to enable it); disabling session search")
+		} else {
+			return err
+		}
+	} else {
+		s.searchEnabled = true
+	}
+	return s.migrateLegacyEvents()
 }
 
 func (s *Server) corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
@@ -163,18 +231,6 @@ func (s *Server) corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-func (s *Server) basicAuth(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		user, pass, ok := r.BasicAuth()
-		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(s.username)) != 1 || subtle.ConstantTimeCompare([]byte(pass), []byte(s.password)) != 1 {
-			w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		next(w, r)
-	}
-}
-
 func (s *Server) sessionMetadataHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -186,23 +242,32 @@ func (s *Server) sessionMetadataHandler(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
+	if !validSessionID.MatchString(metadata.SessionID) {
+		http.Error(w, "Invalid sessionId", http.StatusBadRequest)
+		return
+	}
 
 	viewport, _ := json.Marshal(metadata.Viewport)
+	country := GeoIPLookup(clientIP(r))
 
 	query := `
-	INSERT OR REPLACE INTO sessions (session_id, url, title, user_agent, viewport, created_at, updated_at)
-	VALUES (?, ?, ?, ?, ?, ?, ?)
+	INSERT OR REPLACE INTO sessions (session_id, url, title, user_agent, viewport, viewport_width, country, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
 	now := time.Now()
 	_, err := s.db.Exec(query, metadata.SessionID, metadata.URL, metadata.Title,
-		metadata.UserAgent, string(viewport), now, now)
+		metadata.UserAgent, string(viewport), metadata.Viewport.Width, country, now, now)
 	if err != nil {
 		log.Printf("Error saving session metadata: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
+	if err := s.upsertSessionFTS(metadata.SessionID); err != nil {
+		log.Printf("Error indexing session %s for search: %v", metadata.SessionID, err)
+	}
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
@@ -219,39 +284,87 @@ func (s *Server) sessionEventsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get existing events
-	var existingEvents string
-	err := s.db.QueryRow("SELECT events FROM sessions WHERE session_id = ?", batch.SessionID).Scan(&existingEvents)
+	var sessionURL string
+	err := s.db.QueryRow("SELECT url FROM sessions WHERE session_id = ?", batch.SessionID).Scan(&sessionURL)
 	if err != nil {
-		log.Printf("Error getting existing events: %v", err)
 		http.Error(w, "Session not found", http.StatusNotFound)
 		return
 	}
 
-	// Append new events
-	var allEvents []interface{}
-	if existingEvents != "" {
-		if err := json.Unmarshal([]byte(existingEvents), &allEvents); err != nil {
-			log.Printf("Error unmarshaling existing events: %v", err)
-		}
+	storedCount, err := s.sessionEventCount(batch.SessionID)
+	if err != nil {
+		log.Printf("Error counting stored events: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
 	}
 
-	allEvents = append(allEvents, batch.Events...)
-	eventsJSON, _ := json.Marshal(allEvents)
-
-	// Update session with new events
-	query := `UPDATE sessions SET events = ?, updated_at = ? WHERE session_id = ?`
-	_, err = s.db.Exec(query, string(eventsJSON), time.Now(), batch.SessionID)
+	chain := s.buildProcessorChain(sessionURL, storedCount)
+	events, err := runProcessorChain(chain, batch.Events)
 	if err != nil {
-		log.Printf("Error updating session events: %v", err)
+		log.Printf("Error running event processor chain: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
+	// Each batch is appended as its own chunk; prior chunks are never
+	// re-read or rewritten. A batch that's entirely filtered out (e.g. the
+	// whole URL was rejected) isn't worth a chunk.
+	if len(events) > 0 {
+		if err := s.appendEventChunk(batch.SessionID, events); err != nil {
+			log.Printf("Error appending event chunk: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if err := s.appendDerivedFields(batch.SessionID, extractDerivedFields(events)); err != nil {
+			log.Printf("Error updating derived search fields for session %s: %v", batch.SessionID, err)
+		}
+		s.broadcastLiveEvents(batch.SessionID, events)
+	}
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
+// sessionEventsStreamHandler streams a session's events, in chunk order, as
+// a single JSON array. Used by the replay page so the player can start
+// rendering before the whole session has been read off disk.
+func (s *Server) sessionEventsStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/sessions/"), "/events")
+	if sessionID == "" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	var exists bool
+	if err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM sessions WHERE session_id = ?)", sessionID).Scan(&exists); err != nil || !exists {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := streamSessionEvents(w, s.db, sessionID); err != nil {
+		log.Printf("Error streaming events for session %s: %v", sessionID, err)
+	}
+}
+
+// sessionsByIDHandler dispatches requests under /api/sessions/{id}/... that
+// aren't already matched by one of the fixed-path handlers above.
+func (s *Server) sessionsByIDHandler(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/events"):
+		s.sessionEventsStreamHandler(w, r)
+	case strings.HasSuffix(r.URL.Path, "/export"):
+		s.exportSessionHandler(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
 func (s *Server) getSessionsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -266,9 +379,14 @@ func (s *Server) getSessionsHandler(w http.ResponseWriter, r *http.Request) {
 	limit := 20
 	offset := (page - 1) * limit
 
-	// Get total count
+	// Get total count. Events moved out of sessions.events and into
+	// session_events (see events_store.go), so a session now counts as
+	// having events if it has any chunk rows, not a non-empty column.
 	var total int
-	err := s.db.QueryRow("SELECT COUNT(*) FROM sessions WHERE events != ''").Scan(&total)
+	err := s.db.QueryRow(`
+	SELECT COUNT(*) FROM sessions s
+	WHERE EXISTS (SELECT 1 FROM session_events WHERE session_id = s.session_id)
+	`).Scan(&total)
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
@@ -277,9 +395,9 @@ func (s *Server) getSessionsHandler(w http.ResponseWriter, r *http.Request) {
 	// Get sessions
 	query := `
 	SELECT id, session_id, url, title, user_agent, created_at, updated_at, viewport
-	FROM sessions 
-	WHERE events != ''
-	ORDER BY updated_at DESC 
+	FROM sessions s
+	WHERE EXISTS (SELECT 1 FROM session_events WHERE session_id = s.session_id)
+	ORDER BY updated_at DESC
 	LIMIT ? OFFSET ?
 	`
 
@@ -338,18 +456,86 @@ func (s *Server) adminHandler(w http.ResponseWriter, r *http.Request) {
         .loading { text-align: center; padding: 40px; color: #666; }
         .error { color: #d32f2f; text-align: center; padding: 20px; }
         .stats { background: #e3f2fd; padding: 15px; border-radius: 4px; margin-bottom: 20px; }
+        .header-row { display: flex; justify-content: space-between; align-items: center; }
+        .logout-link { color: #007cba; text-decoration: none; font-size: 14px; }
+        .logout-link:hover { text-decoration: underline; }
+        .search-bar { display: flex; gap: 10px; margin: 15px 0; flex-wrap: wrap; align-items: center; }
+        .search-bar input[type=text] { padding: 8px; border: 1px solid #ddd; border-radius: 4px; }
+        .search-bar input[type=text]#searchQuery { flex: 1; min-width: 200px; }
+        .search-bar label { font-size: 13px; color: #555; }
+        .search-bar button { padding: 8px 16px; background: #007cba; color: white; border: none; border-radius: 4px; cursor: pointer; }
     </style>
 </head>
 <body>
     <div class="container">
-        <h1>🎥 Session Recorder Admin</h1>
+        <div class="header-row">
+            <h1>🎥 Session Recorder Admin</h1>
+            <a href="/logout" class="logout-link">Abmelden</a>
+        </div>
+        <form class="search-bar" id="searchForm" onsubmit="return runSearch(event)">
+            <input type="text" id="searchQuery" placeholder="Volltextsuche (URL, Titel, Klicktext, Fehler ...)">
+            <label><input type="checkbox" id="searchHasError"> nur mit Fehlern</label>
+            <button type="submit">Suchen</button>
+            <button type="button" onclick="clearSearch()">Zurücksetzen</button>
+        </form>
         <div id="stats" class="stats"></div>
         <div id="content" class="loading">Lade Sessions...</div>
     </div>
 
     <script>
         let currentPage = 1;
-        
+
+        function runSearch(event) {
+            event.preventDefault();
+            const params = new URLSearchParams();
+            const q = document.getElementById('searchQuery').value.trim();
+            if (q) params.set('q', q);
+            if (document.getElementById('searchHasError').checked) params.set('has_error', 'true');
+
+            document.getElementById('content').innerHTML = '<div class="loading">Suche läuft...</div>';
+            fetch('/api/sessions/search?' + params.toString())
+                .then(r => r.json())
+                .then(renderSearchResults)
+                .catch(error => {
+                    document.getElementById('content').innerHTML = '<div class="error">Fehler bei der Suche: ' + error.message + '</div>';
+                });
+            return false;
+        }
+
+        function clearSearch() {
+            document.getElementById('searchQuery').value = '';
+            document.getElementById('searchHasError').checked = false;
+            loadSessions(1);
+        }
+
+        function renderSearchResults(data) {
+            const stats = document.getElementById('stats');
+            stats.innerHTML = '🔎 <strong>' + data.sessions.length + '</strong> Treffer' + (data.has_more ? ' (weitere vorhanden)' : '');
+
+            const content = document.getElementById('content');
+            if (data.sessions.length === 0) {
+                content.innerHTML = '<div class="error">Keine Treffer.</div>';
+                return;
+            }
+
+            let html = '<table class="sessions-table"><thead><tr>';
+            html += '<th>Session ID</th><th>URL</th><th>Titel</th><th>Dauer</th><th>Events</th><th>Land</th><th>Aktion</th>';
+            html += '</tr></thead><tbody>';
+            data.sessions.forEach(session => {
+                html += '<tr>';
+                html += '<td>' + session.session_id.substring(0, 20) + '...</td>';
+                html += '<td><a href="' + session.url + '" target="_blank">' + (session.url.length > 50 ? session.url.substring(0, 50) + '...' : session.url) + '</a></td>';
+                html += '<td>' + session.title + '</td>';
+                html += '<td>' + Math.round(session.duration_ms / 1000) + 's</td>';
+                html += '<td>' + session.event_count + '</td>';
+                html += '<td>' + (session.country || '-') + '</td>';
+                html += '<td><a href="/session/' + session.session_id + '" class="session-link" target="_blank">📽️ Ansehen</a> <a href="/api/sessions/' + session.session_id + '/export">📦 Export</a></td>';
+                html += '</tr>';
+            });
+            html += '</tbody></table>';
+            content.innerHTML = html;
+        }
+
         async function loadSessions(page = 1) {
             try {
                 document.getElementById('content').innerHTML = '<div class="loading">Lade Sessions...</div>';
@@ -379,6 +565,7 @@ func (s *Server) adminHandler(w http.ResponseWriter, r *http.Request) {
             }
             
             let html = '<table class="sessions-table"><thead><tr>';
+            html += '<th>Status</th>';
             html += '<th>Session ID</th>';
             html += '<th>URL</th>';
             html += '<th>Titel</th>';
@@ -386,19 +573,22 @@ func (s *Server) adminHandler(w http.ResponseWriter, r *http.Request) {
             html += '<th>Browser Agent</th>';
             html += '<th>Aktion</th>';
             html += '</tr></thead><tbody>';
-            
+
+            const LIVE_WINDOW_SECONDS = 30;
             data.sessions.forEach(session => {
                 const date = new Date(session.created_at).toLocaleString('de-DE');
+                const isLive = (Date.now() - new Date(session.updated_at).getTime()) / 1000 < LIVE_WINDOW_SECONDS;
                 html += '<tr>';
+                html += '<td>' + (isLive ? '<a href="/live/' + session.session_id + '" target="_blank">🔴 LIVE</a>' : '') + '</td>';
                 html += '<td>' + session.session_id.substring(0, 20) + '...</td>';
                 html += '<td><a href="' + session.url + '" target="_blank">' + (session.url.length > 50 ? session.url.substring(0, 50) + '...' : session.url) + '</a></td>';
                 html += '<td>' + session.title + '</td>';
                 html += '<td>' + date + '</td>';
                 html += '<td class="user-agent">' + session.user_agent + '</td>';
-                html += '<td><a href="/session/' + session.session_id + '" class="session-link" target="_blank">📽️ Ansehen</a></td>';
+                html += '<td><a href="/session/' + session.session_id + '" class="session-link" target="_blank">📽️ Ansehen</a> <a href="/api/sessions/' + session.session_id + '/export">📦 Export</a></td>';
                 html += '</tr>';
             });
-            
+
             html += '</tbody></table>';
             
             // Pagination
@@ -441,21 +631,16 @@ func (s *Server) viewSessionHandler(w http.ResponseWriter, r *http.Request) {
 	sessionID := strings.TrimPrefix(r.URL.Path, "/session/")
 
 	var session Session
-	query := `SELECT session_id, url, title, user_agent, events, created_at, viewport FROM sessions WHERE session_id = ?`
+	query := `SELECT session_id, url, title, user_agent, created_at, viewport FROM sessions WHERE session_id = ?`
 	err := s.db.QueryRow(query, sessionID).Scan(
 		&session.SessionID, &session.URL, &session.Title,
-		&session.UserAgent, &session.Events, &session.CreatedAt, &session.Viewport)
+		&session.UserAgent, &session.CreatedAt, &session.Viewport)
 
 	if err != nil {
 		http.Error(w, "Session not found", http.StatusNotFound)
 		return
 	}
 
-	// Validate that events is valid JSON
-	if session.Events == "" {
-		session.Events = "[]"
-	}
-
 	tmpl := `
 <!DOCTYPE html>
 <html lang="de">
@@ -515,17 +700,19 @@ func (s *Server) viewSessionHandler(w http.ResponseWriter, r *http.Request) {
     <div id="player"></div>
 
     <script>
-        let events = [];
-        try {
-            // Events are already a JSON string from the database
-            events = {{rawJS .Events}};
-        } catch (error) {
-            console.error('Error parsing events:', error);
-            events = [];
-        }
+        // Initialize the rrweb player when page loads. Events are streamed
+        // from the server as one JSON array so the player can start as
+        // soon as the response arrives, instead of waiting on an inline blob.
+        document.addEventListener('DOMContentLoaded', async function() {
+            let events = [];
+            try {
+                const response = await fetch('/api/sessions/{{.SessionID}}/events');
+                events = await response.json();
+            } catch (error) {
+                console.error('Error loading events:', error);
+                events = [];
+            }
 
-        // Initialize the rrweb player when page loads
-        document.addEventListener('DOMContentLoaded', function() {
             if (!events || !Array.isArray(events) || events.length === 0) {
                 document.getElementById('player').innerHTML = '<div class="error">Keine Aufzeichnungsdaten verfügbar.</div>';
                 return;
@@ -556,26 +743,19 @@ func (s *Server) viewSessionHandler(w http.ResponseWriter, r *http.Request) {
 </html>
 `
 
-	// Create a template with custom function to output raw JS
-	funcMap := template.FuncMap{
-		"rawJS": func(s string) template.JS {
-			return template.JS(s)
-		},
-	}
-
-	t, err := template.New("session").Funcs(funcMap).Parse(tmpl)
+	t, err := template.New("session").Parse(tmpl)
 	if err != nil {
 		http.Error(w, "Template error", http.StatusInternalServerError)
 		return
 	}
 
-    data := struct {
-        Session
-        RrWebJs string
-    }{
-        Session: session,
-        RrWebJs: s.rrWebJs,
-    }
+	data := struct {
+		Session
+		RrWebJs string
+	}{
+		Session: session,
+		RrWebJs: s.rrWebJs,
+	}
 
 	w.Header().Set("Content-Type", "text/html")
 	t.Execute(w, data)
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// EventProcessor is a single stage of the ingest pipeline. It inspects one
+// rrweb event and decides whether it should be persisted, optionally
+// redacting fields on it in place before returning.
+type EventProcessor interface {
+	Process(event map[string]interface{}) (keep bool, err error)
+}
+
+// ProcessorConfig controls which processors run on every incoming batch.
+// It's loaded once at startup, either from individual env vars or, if
+// PROCESSOR_CONFIG_JSON is set, from a single JSON document with the same
+// shape as this struct.
+type ProcessorConfig struct {
+	MaskInputs          bool     `json:"maskInputs"`
+	InputAllowlist      []string `json:"inputAllowlist"`
+	DropMouseMove       bool     `json:"dropMouseMove"`
+	URLAllowlistPattern string   `json:"urlAllowlistPattern"`
+	MaxEventsPerSession int      `json:"maxEventsPerSession"`
+}
+
+// loadProcessorConfig reads the pipeline configuration from the
+// environment. MASK_INPUTS defaults to true since PII scrubbing should be
+// opt-out, not opt-in.
+func loadProcessorConfig() ProcessorConfig {
+	cfg := ProcessorConfig{MaskInputs: true}
+
+	if raw := os.Getenv("PROCESSOR_CONFIG_JSON"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &cfg); err != nil {
+			log.Printf("Error parsing PROCESSOR_CONFIG_JSON, falling back to defaults: %v", err)
+			cfg = ProcessorConfig{MaskInputs: true}
+		}
+		return cfg
+	}
+
+	if v := os.Getenv("MASK_INPUTS"); v != "" {
+		cfg.MaskInputs = v == "true"
+	}
+	if v := os.Getenv("INPUT_ALLOWLIST"); v != "" {
+		for _, sel := range strings.Split(v, ",") {
+			if sel = strings.TrimSpace(sel); sel != "" {
+				cfg.InputAllowlist = append(cfg.InputAllowlist, sel)
+			}
+		}
+	}
+	if v := os.Getenv("DROP_MOUSE_MOVE"); v != "" {
+		cfg.DropMouseMove = v == "true"
+	}
+	if v := os.Getenv("URL_ALLOWLIST_PATTERN"); v != "" {
+		cfg.URLAllowlistPattern = v
+	}
+	if v := os.Getenv("MAX_EVENTS_PER_SESSION"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.MaxEventsPerSession = n
+		}
+	}
+	return cfg
+}
+
+// buildProcessorChain builds the processors that should run against one
+// incoming batch. sessionURL and eventsAlreadyStored carry the per-session
+// state a couple of the processors need (URL allowlisting, the running
+// event cap) without making EventProcessor itself session-aware.
+func (s *Server) buildProcessorChain(sessionURL string, eventsAlreadyStored int) []EventProcessor {
+	cfg := s.processorConfig
+	var chain []EventProcessor
+
+	if cfg.URLAllowlistPattern != "" {
+		if pattern, err := regexp.Compile(cfg.URLAllowlistPattern); err == nil {
+			chain = append(chain, &URLAllowlistProcessor{Pattern: pattern, SessionURL: sessionURL})
+		} else {
+			log.Printf("Invalid URL_ALLOWLIST_PATTERN %q: %v", cfg.URLAllowlistPattern, err)
+		}
+	}
+	if cfg.MaskInputs {
+		chain = append(chain, NewMaskInputsProcessor(cfg.InputAllowlist))
+	}
+	if cfg.DropMouseMove {
+		chain = append(chain, &DropEventTypesProcessor{Drop: []eventTypeSource{{Type: 3, Source: 1}}})
+	}
+	if cfg.MaxEventsPerSession > 0 {
+		chain = append(chain, &MaxEventsPerSessionProcessor{Max: cfg.MaxEventsPerSession, AlreadyStored: eventsAlreadyStored})
+	}
+	return chain
+}
+
+// runProcessorChain runs every event in a batch through the chain in order,
+// keeping only events every processor agrees to keep.
+func runProcessorChain(chain []EventProcessor, events []interface{}) ([]interface{}, error) {
+	if len(chain) == 0 {
+		return events, nil
+	}
+
+	kept := make([]interface{}, 0, len(events))
+eventLoop:
+	for _, raw := range events {
+		event, ok := raw.(map[string]interface{})
+		if !ok {
+			kept = append(kept, raw)
+			continue
+		}
+		for _, p := range chain {
+			keepEvent, err := p.Process(event)
+			if err != nil {
+				return nil, err
+			}
+			if !keepEvent {
+				continue eventLoop
+			}
+		}
+		kept = append(kept, event)
+	}
+	return kept, nil
+}
+
+// MaskInputsProcessor redacts the value of rrweb input events (IncrementalSnapshot,
+// type 3, source 5) unless the input's target selector is on the allowlist.
+// This is the server-side backstop for recorders that can't be trusted to
+// mask sensitive form fields themselves.
+type MaskInputsProcessor struct {
+	allowlist map[string]bool
+}
+
+func NewMaskInputsProcessor(allowlist []string) *MaskInputsProcessor {
+	set := make(map[string]bool, len(allowlist))
+	for _, sel := range allowlist {
+		set[sel] = true
+	}
+	return &MaskInputsProcessor{allowlist: set}
+}
+
+func (p *MaskInputsProcessor) Process(event map[string]interface{}) (bool, error) {
+	if t, ok := eventType(event); !ok || t != 3 {
+		return true, nil
+	}
+
+	data, _ := event["data"].(map[string]interface{})
+	if data == nil {
+		return true, nil
+	}
+	if source, _ := data["source"].(float64); source != 5 {
+		return true, nil
+	}
+	if _, hasValue := data["value"]; !hasValue {
+		return true, nil
+	}
+
+	selector, _ := data["selector"].(string)
+	if p.allowlist[selector] {
+		return true, nil
+	}
+
+	data["value"] = "***"
+	return true, nil
+}
+
+// eventTypeSource identifies an rrweb event by its outer type and, for
+// IncrementalSnapshot events, the incremental source.
+type eventTypeSource struct {
+	Type   float64
+	Source float64
+}
+
+// DropEventTypesProcessor drops events matching a (type, source) pair
+// outright, e.g. mouse-move noise (type 3, source 1).
+type DropEventTypesProcessor struct {
+	Drop []eventTypeSource
+}
+
+func (p *DropEventTypesProcessor) Process(event map[string]interface{}) (bool, error) {
+	t, ok := eventType(event)
+	if !ok {
+		return true, nil
+	}
+	var source float64
+	if data, ok := event["data"].(map[string]interface{}); ok {
+		source, _ = data["source"].(float64)
+	}
+
+	for _, d := range p.Drop {
+		if d.Type == t && d.Source == source {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// URLAllowlistProcessor rejects every event in a batch whose parent
+// session's URL doesn't match Pattern. It's evaluated per-event like the
+// rest of the chain, but the decision is the same for the whole batch since
+// it only looks at SessionURL.
+type URLAllowlistProcessor struct {
+	Pattern    *regexp.Regexp
+	SessionURL string
+}
+
+func (p *URLAllowlistProcessor) Process(event map[string]interface{}) (bool, error) {
+	if p.Pattern == nil {
+		return true, nil
+	}
+	return p.Pattern.MatchString(p.SessionURL), nil
+}
+
+// MaxEventsPerSessionProcessor caps the total number of events a session can
+// accumulate, dropping anything past the limit. AlreadyStored is the count
+// persisted before this batch arrived.
+type MaxEventsPerSessionProcessor struct {
+	Max           int
+	AlreadyStored int
+	kept          int
+}
+
+func (p *MaxEventsPerSessionProcessor) Process(event map[string]interface{}) (bool, error) {
+	if p.AlreadyStored+p.kept >= p.Max {
+		return false, nil
+	}
+	p.kept++
+	return true, nil
+}
+
+func eventType(event map[string]interface{}) (float64, bool) {
+	t, ok := event["type"].(float64)
+	return t, ok
+}
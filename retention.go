@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// archiveConfig controls the cold-storage export the janitor uses before it
+// deletes an expired session. It's read fresh on every run so operators can
+// change the target without restarting the server... well, a restart is
+// still required since it's cached on Server, but keeping it as a small
+// struct makes that obvious if that ever changes.
+type archiveConfig struct {
+	Bucket    string
+	Endpoint  string
+	AccessKey string
+	SecretKey string
+	Region    string
+}
+
+func loadArchiveConfig() archiveConfig {
+	return archiveConfig{
+		Bucket:    os.Getenv("ARCHIVE_S3_BUCKET"),
+		Endpoint:  strings.TrimSuffix(os.Getenv("ARCHIVE_S3_ENDPOINT"), "/"),
+		AccessKey: os.Getenv("ARCHIVE_S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("ARCHIVE_S3_SECRET_KEY"),
+		Region:    envOrDefault("ARCHIVE_S3_REGION", "us-east-1"),
+	}
+}
+
+func (c archiveConfig) enabled() bool {
+	return c.Bucket != "" && c.Endpoint != ""
+}
+
+func envOrDefault(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func retentionDays() int {
+	days := 30
+	if v := os.Getenv("RETENTION_DAYS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			days = n
+		}
+	}
+	return days
+}
+
+// archiveRecord is one line of the NDJSON export format: either the
+// session's own metadata (including the search-derived columns chunk0-5
+// added, which aren't recoverable from the event stream alone) or a single
+// rrweb event, in original order.
+type archiveRecord struct {
+	Type          string      `json:"type"`
+	Session       *Session    `json:"session,omitempty"`
+	DurationMs    int         `json:"duration_ms,omitempty"`
+	Country       string      `json:"country,omitempty"`
+	ClickedText   string      `json:"clicked_text,omitempty"`
+	PagePaths     string      `json:"page_paths,omitempty"`
+	ErrorMessages string      `json:"error_messages,omitempty"`
+	Event         interface{} `json:"event,omitempty"`
+}
+
+// exportSession serializes a session's metadata and full event stream as
+// gzipped NDJSON - the format used both for the on-demand export endpoint
+// and for what the janitor uploads to cold storage before deleting a row.
+func (s *Server) exportSession(sessionID string) ([]byte, error) {
+	var session Session
+	var durationMs int
+	var country, clickedText, pagePaths, errorMessages string
+	err := s.db.QueryRow(`
+		SELECT session_id, url, title, user_agent, created_at, updated_at, viewport, duration_ms,
+		       country, clicked_text, page_paths, error_messages
+		FROM sessions WHERE session_id = ?`, sessionID).
+		Scan(&session.SessionID, &session.URL, &session.Title, &session.UserAgent, &session.CreatedAt, &session.UpdatedAt, &session.Viewport, &durationMs,
+			&country, &clickedText, &pagePaths, &errorMessages)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(gw)
+
+	if err := enc.Encode(archiveRecord{
+		Type:          "session",
+		Session:       &session,
+		DurationMs:    durationMs,
+		Country:       country,
+		ClickedText:   clickedText,
+		PagePaths:     pagePaths,
+		ErrorMessages: errorMessages,
+	}); err != nil {
+		gw.Close()
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`SELECT payload, compressed FROM session_events WHERE session_id = ? ORDER BY seq ASC`, sessionID)
+	if err != nil {
+		gw.Close()
+		return nil, err
+	}
+	for rows.Next() {
+		var payload []byte
+		var compressed bool
+		if err := rows.Scan(&payload, &compressed); err != nil {
+			continue
+		}
+		raw := payload
+		if compressed {
+			raw, err = gunzip(payload)
+			if err != nil {
+				rows.Close()
+				gw.Close()
+				return nil, err
+			}
+		}
+		var events []json.RawMessage
+		if err := json.Unmarshal(raw, &events); err != nil {
+			continue
+		}
+		for _, e := range events {
+			if err := enc.Encode(archiveRecord{Type: "event", Event: e}); err != nil {
+				rows.Close()
+				gw.Close()
+				return nil, err
+			}
+		}
+	}
+	rows.Close()
+
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// importSession re-hydrates a session previously written by exportSession:
+// it recreates the sessions row and stores every archived event as a
+// single chunk, so the usual replay and streaming endpoints work unchanged.
+func (s *Server) importSession(data []byte) (string, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("import: %w", err)
+	}
+	defer gr.Close()
+
+	var session *Session
+	var durationMs int
+	var country, clickedText, pagePaths, errorMessages string
+	var events []interface{}
+
+	scanner := bufio.NewScanner(gr)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var rec archiveRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		switch rec.Type {
+		case "session":
+			session = rec.Session
+			durationMs = rec.DurationMs
+			country = rec.Country
+			clickedText = rec.ClickedText
+			pagePaths = rec.PagePaths
+			errorMessages = rec.ErrorMessages
+		case "event":
+			events = append(events, rec.Event)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if session == nil {
+		return "", fmt.Errorf("import: archive has no session record")
+	}
+	if !validSessionID.MatchString(session.SessionID) {
+		return "", fmt.Errorf("import: invalid session_id %q", session.SessionID)
+	}
+
+	// A session with this ID may already exist (re-import of the same
+	// archive, or import racing the janitor's delete); drop any chunks and
+	// search index row it left behind so we don't append a duplicate copy
+	// of every event on top of them.
+	if _, err := s.db.Exec(`DELETE FROM session_events WHERE session_id = ?`, session.SessionID); err != nil {
+		return "", err
+	}
+	if s.searchEnabled {
+		if _, err := s.db.Exec(`DELETE FROM sessions_fts WHERE session_id = ?`, session.SessionID); err != nil {
+			return "", err
+		}
+	}
+
+	_, err = s.db.Exec(`
+		INSERT OR REPLACE INTO sessions (session_id, url, title, user_agent, viewport, duration_ms, event_count,
+			country, clicked_text, page_paths, error_messages, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		session.SessionID, session.URL, session.Title, session.UserAgent, session.Viewport,
+		durationMs, len(events), country, clickedText, pagePaths, errorMessages,
+		session.CreatedAt, session.UpdatedAt)
+	if err != nil {
+		return "", err
+	}
+
+	if len(events) > 0 {
+		if err := s.appendEventChunk(session.SessionID, events); err != nil {
+			return "", err
+		}
+	}
+	if err := s.upsertSessionFTS(session.SessionID); err != nil {
+		log.Printf("Error indexing imported session %s for search: %v", session.SessionID, err)
+	}
+	return session.SessionID, nil
+}
+
+// exportSessionHandler backs GET /api/sessions/{id}/export: downloads a
+// session in the same gzipped NDJSON format the janitor archives to S3.
+func (s *Server) exportSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sessionID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/sessions/"), "/export")
+	if sessionID == "" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	data, err := s.exportSession(sessionID)
+	if err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.json.gz"`, sessionID))
+	w.Write(data)
+}
+
+// importSessionHandler backs POST /api/sessions/import: the request body is
+// a gzipped NDJSON archive, as produced by exportSession.
+func (s *Server) importSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading body", http.StatusBadRequest)
+		return
+	}
+
+	sessionID, err := s.importSession(data)
+	if err != nil {
+		log.Printf("Error importing session archive: %v", err)
+		http.Error(w, "Invalid archive", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok", "session_id": sessionID})
+}
+
+// runRetentionJanitor periodically deletes sessions older than
+// RETENTION_DAYS, archiving each one to S3-compatible storage first if
+// ARCHIVE_S3_BUCKET/ARCHIVE_S3_ENDPOINT are set.
+func (s *Server) runRetentionJanitor() {
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+
+	s.expireOldSessions()
+	for range ticker.C {
+		s.expireOldSessions()
+	}
+}
+
+func (s *Server) expireOldSessions() {
+	cutoff := time.Now().AddDate(0, 0, -retentionDays())
+	archive := loadArchiveConfig()
+
+	rows, err := s.db.Query(`SELECT session_id, created_at FROM sessions WHERE created_at < ?`, cutoff)
+	if err != nil {
+		log.Printf("Error listing expired sessions: %v", err)
+		return
+	}
+	type expired struct {
+		sessionID string
+		createdAt time.Time
+	}
+	var sessions []expired
+	for rows.Next() {
+		var e expired
+		if err := rows.Scan(&e.sessionID, &e.createdAt); err == nil {
+			sessions = append(sessions, e)
+		}
+	}
+	rows.Close()
+
+	for _, e := range sessions {
+		if archive.enabled() {
+			data, err := s.exportSession(e.sessionID)
+			if err != nil {
+				log.Printf("Error archiving session %s, skipping deletion: %v", e.sessionID, err)
+				continue
+			}
+			key := fmt.Sprintf("sessions/%s/%s.json.gz", e.createdAt.Format("2006/01/02"), e.sessionID)
+			if err := putObjectS3(archive, key, data); err != nil {
+				log.Printf("Error uploading archive for session %s, skipping deletion: %v", e.sessionID, err)
+				continue
+			}
+		}
+
+		if err := s.deleteSession(e.sessionID); err != nil {
+			log.Printf("Error deleting expired session %s: %v", e.sessionID, err)
+		}
+	}
+}
+
+func (s *Server) deleteSession(sessionID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM session_events WHERE session_id = ?`, sessionID); err != nil {
+		return err
+	}
+	if s.searchEnabled {
+		if _, err := tx.Exec(`DELETE FROM sessions_fts WHERE session_id = ?`, sessionID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM sessions WHERE session_id = ?`, sessionID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// putObjectS3 uploads data to an S3-compatible endpoint using a path-style
+// request signed with AWS Signature Version 4. It's a deliberately small,
+// dependency-free client: the janitor only ever needs a single PUT.
+func putObjectS3(cfg archiveConfig, key string, data []byte) error {
+	url := fmt.Sprintf("%s/%s/%s", cfg.Endpoint, cfg.Bucket, key)
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+
+	if err := signS3Request(req, cfg, data); err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("S3 PUT %s failed: %s: %s", url, resp.Status, body)
+	}
+	return nil
+}
+
+// signS3Request adds the headers and Authorization value for AWS Signature
+// Version 4, the scheme MinIO and most other S3-compatible stores accept.
+func signS3Request(req *http.Request, cfg archiveConfig, body []byte) error {
+	const service = "s3"
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	dateStamp := now.Format("20060102")
+
+	payloadHash := sha256Hex(body)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	req.Header.Set("Host", req.URL.Host)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := fmt.Sprintf("host:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n",
+		req.URL.Host, payloadHash, amzDate)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"",
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", dateStamp, cfg.Region, service)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := hmacSHA256(hmacSHA256(hmacSHA256(hmacSHA256([]byte("AWS4"+cfg.SecretKey), dateStamp), cfg.Region), service), "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		cfg.AccessKey, scope, signedHeaders, signature))
+	return nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
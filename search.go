@@ -0,0 +1,373 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sessionIdleTimeout is how long a session must go without a new batch
+// before it's considered finished and gets its duration_ms/event_count
+// finalized for search/filtering.
+func sessionIdleTimeout() time.Duration {
+	seconds := 60
+	if v := os.Getenv("SESSION_IDLE_TIMEOUT_SECONDS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			seconds = n
+		}
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// runIdleSessionFinalizer periodically finalizes sessions that have gone
+// quiet: it sums up their chunk metadata into duration_ms/event_count so
+// search filters don't need to touch the event payloads themselves.
+func (s *Server) runIdleSessionFinalizer() {
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := s.finalizeIdleSessions(); err != nil {
+			log.Printf("Error finalizing idle sessions: %v", err)
+		}
+	}
+}
+
+func (s *Server) finalizeIdleSessions() error {
+	idleBefore := time.Now().Add(-sessionIdleTimeout())
+
+	rows, err := s.db.Query(`
+		SELECT session_id FROM sessions
+		WHERE duration_ms = 0 AND updated_at < ?`, idleBefore)
+	if err != nil {
+		return err
+	}
+	var sessionIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			sessionIDs = append(sessionIDs, id)
+		}
+	}
+	rows.Close()
+
+	for _, sessionID := range sessionIDs {
+		var durationMs, eventCount int
+		err := s.db.QueryRow(`
+			SELECT COALESCE(MAX(ts_end) - MIN(ts_start), 0), COALESCE(SUM(event_count), 0)
+			FROM session_events WHERE session_id = ?`, sessionID).Scan(&durationMs, &eventCount)
+		if err != nil {
+			log.Printf("Error computing duration for session %s: %v", sessionID, err)
+			continue
+		}
+		if eventCount == 0 {
+			// Nothing was ever stored (e.g. every batch got filtered out);
+			// leave it as-is rather than marking a zero-length session final.
+			continue
+		}
+		if _, err := s.db.Exec(`UPDATE sessions SET duration_ms = ?, event_count = ? WHERE session_id = ?`,
+			durationMs, eventCount, sessionID); err != nil {
+			log.Printf("Error finalizing session %s: %v", sessionID, err)
+		}
+	}
+	return nil
+}
+
+// searchSchema adds the FTS5 index backing full-text session search.
+// Building this binary requires the sqlite_fts5 build tag (see Makefile);
+// without it, SQLite returns "no such module: fts5" here.
+const searchSchema = `
+CREATE VIRTUAL TABLE IF NOT EXISTS sessions_fts USING fts5(
+	session_id UNINDEXED,
+	url,
+	title,
+	user_agent,
+	clicked_text,
+	page_paths,
+	error_messages,
+	country
+);
+`
+
+// addColumnIfMissing runs an ALTER TABLE ADD COLUMN, tolerating the
+// duplicate-column error SQLite returns when it's already been applied.
+func addColumnIfMissing(db *sql.DB, ddl string) error {
+	_, err := db.Exec(ddl)
+	if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		return err
+	}
+	return nil
+}
+
+// ensureSearchColumns adds the columns search filtering and faceting need
+// directly to sessions, so they can be queried without touching the event
+// chunks.
+func ensureSearchColumns(db *sql.DB) error {
+	columns := []string{
+		`ALTER TABLE sessions ADD COLUMN duration_ms INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE sessions ADD COLUMN event_count INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE sessions ADD COLUMN viewport_width INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE sessions ADD COLUMN country TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE sessions ADD COLUMN clicked_text TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE sessions ADD COLUMN page_paths TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE sessions ADD COLUMN error_messages TEXT NOT NULL DEFAULT ''`,
+	}
+	for _, ddl := range columns {
+		if err := addColumnIfMissing(db, ddl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GeoIPLookup resolves a country code for a client IP. It's a package-level
+// hook so operators can swap in a real GeoIP database at startup; the
+// default leaves country blank.
+var GeoIPLookup = func(ip string) string { return "" }
+
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// upsertSessionFTS refreshes the search index row for a session from its
+// current column values. FTS5 has no natural upsert, so this just replaces
+// the row wholesale. It's a no-op when the server started without FTS5
+// support (see initDB), since sessions_fts doesn't exist in that case.
+func (s *Server) upsertSessionFTS(sessionID string) error {
+	if !s.searchEnabled {
+		return nil
+	}
+	db := s.db
+
+	var url, title, userAgent, clickedText, pagePaths, errorMessages, country string
+	err := db.QueryRow(`SELECT url, title, user_agent, clicked_text, page_paths, error_messages, country FROM sessions WHERE session_id = ?`, sessionID).
+		Scan(&url, &title, &userAgent, &clickedText, &pagePaths, &errorMessages, &country)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM sessions_fts WHERE session_id = ?`, sessionID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO sessions_fts (session_id, url, title, user_agent, clicked_text, page_paths, error_messages, country) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		sessionID, url, title, userAgent, clickedText, pagePaths, errorMessages, country); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// derivedEventFields pulls the bits of an event batch worth indexing:
+// page paths visited (Meta events), console errors surfaced via custom
+// events, and click target text, also surfaced via custom events since
+// rrweb snapshots don't carry text directly.
+type derivedEventFields struct {
+	pagePaths     []string
+	errorMessages []string
+	clickedText   []string
+}
+
+func extractDerivedFields(events []interface{}) derivedEventFields {
+	var fields derivedEventFields
+	for _, raw := range events {
+		event, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		t, ok := eventType(event)
+		if !ok {
+			continue
+		}
+		data, _ := event["data"].(map[string]interface{})
+		if data == nil {
+			continue
+		}
+
+		switch t {
+		case 4: // Meta
+			if href, ok := data["href"].(string); ok && href != "" {
+				fields.pagePaths = append(fields.pagePaths, href)
+			}
+		case 5: // Custom
+			tag, _ := data["tag"].(string)
+			payload, _ := data["payload"].(map[string]interface{})
+			if payload == nil {
+				continue
+			}
+			switch tag {
+			case "console-error":
+				if msg, ok := payload["message"].(string); ok && msg != "" {
+					fields.errorMessages = append(fields.errorMessages, msg)
+				}
+			case "click":
+				if text, ok := payload["text"].(string); ok && text != "" {
+					fields.clickedText = append(fields.clickedText, text)
+				}
+			}
+		}
+	}
+	return fields
+}
+
+// appendDerivedFields folds newly extracted fields into the session's
+// existing derived-field columns and refreshes its search index row. These
+// columns stay small (short strings, not whole event payloads), so reading
+// and rewriting them per batch is cheap.
+func (s *Server) appendDerivedFields(sessionID string, fields derivedEventFields) error {
+	if len(fields.pagePaths) == 0 && len(fields.errorMessages) == 0 && len(fields.clickedText) == 0 {
+		return nil
+	}
+
+	_, err := s.db.Exec(`
+		UPDATE sessions SET
+			page_paths = TRIM(page_paths || ' ' || ?),
+			error_messages = TRIM(error_messages || ' ' || ?),
+			clicked_text = TRIM(clicked_text || ' ' || ?)
+		WHERE session_id = ?`,
+		strings.Join(fields.pagePaths, " "),
+		strings.Join(fields.errorMessages, " "),
+		strings.Join(fields.clickedText, " "),
+		sessionID)
+	if err != nil {
+		return err
+	}
+	return s.upsertSessionFTS(sessionID)
+}
+
+// searchSessionsHandler backs /api/sessions/search: free-text search over
+// sessions_fts combined with structured filters on the sessions table,
+// with cursor (id-based) pagination.
+func (s *Server) searchSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	limit := 20
+	if v := q.Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= 100 {
+			limit = n
+		}
+	}
+	cursor := 0
+	if v := q.Get("cursor"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cursor = n
+		}
+	}
+
+	var (
+		joins []string
+		where []string
+		args  []interface{}
+	)
+	where = append(where, "s.id > ?")
+	args = append(args, cursor)
+
+	if text := q.Get("q"); text != "" && !s.searchEnabled {
+		http.Error(w, "Full-text search is unavailable: server was built without sqlite_fts5", http.StatusServiceUnavailable)
+		return
+	}
+	if text := q.Get("q"); text != "" {
+		joins = append(joins, "JOIN sessions_fts ON sessions_fts.session_id = s.session_id")
+		where = append(where, "sessions_fts MATCH ?")
+		args = append(args, text)
+	}
+	if glob := q.Get("url_glob"); glob != "" {
+		where = append(where, "s.url GLOB ?")
+		args = append(args, glob)
+	}
+	if v := q.Get("min_duration"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			where = append(where, "s.duration_ms >= ?")
+			args = append(args, n)
+		}
+	}
+	if v := q.Get("max_duration"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			where = append(where, "s.duration_ms <= ?")
+			args = append(args, n)
+		}
+	}
+	if q.Get("has_error") == "true" {
+		where = append(where, "s.error_messages != ''")
+	}
+	if v := q.Get("viewport_min_width"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			where = append(where, "s.viewport_width >= ?")
+			args = append(args, n)
+		}
+	}
+	if v := q.Get("date_from"); v != "" {
+		where = append(where, "s.created_at >= ?")
+		args = append(args, v)
+	}
+	if v := q.Get("date_to"); v != "" {
+		where = append(where, "s.created_at <= ?")
+		args = append(args, v)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT s.id, s.session_id, s.url, s.title, s.user_agent, s.created_at, s.updated_at,
+		       s.viewport, s.duration_ms, s.event_count, s.country
+		FROM sessions s
+		%s
+		WHERE %s
+		ORDER BY s.id ASC
+		LIMIT ?`,
+		strings.Join(joins, " "), strings.Join(where, " AND "))
+	args = append(args, limit)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error running session search: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	type searchResult struct {
+		Session
+		DurationMs int    `json:"duration_ms"`
+		EventCount int    `json:"event_count"`
+		Country    string `json:"country"`
+	}
+
+	var results []searchResult
+	for rows.Next() {
+		var res searchResult
+		if err := rows.Scan(&res.ID, &res.SessionID, &res.URL, &res.Title, &res.UserAgent,
+			&res.CreatedAt, &res.UpdatedAt, &res.Viewport, &res.DurationMs, &res.EventCount, &res.Country); err != nil {
+			continue
+		}
+		results = append(results, res)
+	}
+
+	nextCursor := cursor
+	if len(results) > 0 {
+		nextCursor = results[len(results)-1].ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sessions":    results,
+		"next_cursor": nextCursor,
+		"has_more":    len(results) == limit,
+	})
+}